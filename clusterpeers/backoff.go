@@ -0,0 +1,45 @@
+package clusterpeers
+
+import (
+    "math/rand"
+    "time"
+)
+
+// BackoffPolicy configures the reconnect retry schedule used by
+// establishConnection. Delays grow geometrically from InitialDelay up to
+// MaxDelay, with full jitter applied on every attempt to avoid a
+// thundering herd when many peers restart together. MaxRetries bounds
+// the number of dial attempts before a peer is declared unreachable; a
+// value of 0 means retry forever.
+type BackoffPolicy struct {
+    InitialDelay time.Duration
+    MaxDelay time.Duration
+    Multiplier float64
+    MaxRetries uint64
+}
+
+// DefaultBackoffPolicy returns the backoff used when ConstructCluster is
+// not given one explicitly.
+func DefaultBackoffPolicy() BackoffPolicy {
+    return BackoffPolicy {
+        InitialDelay: 100 * time.Millisecond,
+        MaxDelay: 30 * time.Second,
+        Multiplier: 2,
+        MaxRetries: 0,
+    }
+}
+
+// delay returns the full-jitter delay to wait before retry number attempt
+// (0-indexed).
+func (this BackoffPolicy) delay(attempt uint64) time.Duration {
+    max := float64(this.InitialDelay)
+    for i := uint64(0); i < attempt; i++ {
+        max *= this.Multiplier
+        if max >= float64(this.MaxDelay) {
+            max = float64(this.MaxDelay)
+            break
+        }
+    }
+
+    return time.Duration(rand.Int63n(int64(max) + 1))
+}
@@ -1,9 +1,12 @@
 package clusterpeers
 
 import (
+    "context"
+    "crypto/tls"
     "os"
     "fmt"
     "sync"
+    "sync/atomic"
     "time"
     "net"
     "net/rpc"
@@ -11,6 +14,14 @@ import (
     "paxos/acceptor"
 )
 
+// Default timeouts used when a caller's context carries no deadline, and
+// the default live_connections sampling interval.
+const (
+    defaultHeartbeatTimeout = time.Second / 2
+    defaultReplyTimeout = 2 * time.Second
+    defaultMetricsInterval = time.Second
+)
+
 type Cluster struct {
     roleId uint64
     nodes map[uint64]Peer
@@ -18,12 +29,38 @@ type Cluster struct {
     skipPromiseCount uint64
     disk *recovery.Manager
     exclude sync.Mutex
+    ctx context.Context
+    cancel context.CancelFunc
+    log Logger
+    backoff BackoffPolicy
+    unreachable chan uint64
+    transport Transport
+    poolSize int
+    inFlight int64
+    metrics Metrics
+}
+
+// ClusterOptions bundles the pluggable pieces of a Cluster. The zero value
+// is valid: a nil Logger falls back to NewStdLogger(), a zero BackoffPolicy
+// falls back to DefaultBackoffPolicy(), and a nil Transport falls back to
+// TCPTransport{}.
+type ClusterOptions struct {
+    Logger Logger
+    Backoff BackoffPolicy
+    Transport Transport
+    // PoolSize is the number of RPC connections kept open per peer. Zero
+    // falls back to defaultPoolSize.
+    PoolSize int
+    Metrics Metrics
+    // MetricsInterval is how often the live_connections gauge is sampled.
+    // Zero falls back to defaultMetricsInterval.
+    MetricsInterval time.Duration
 }
 
 type Peer struct {
     roleId uint64
     address string
-    comm *rpc.Client
+    pool *connPool
     requirePromise bool
 }
 
@@ -31,7 +68,35 @@ type Response struct {
     Data interface{}
 }
 
-func ConstructCluster(roleId uint64, disk *recovery.Manager) (*Cluster, uint64, string, error) {
+// ConstructCluster builds the cluster's peer table from disk and starts its
+// background connection manager. See ClusterOptions for the defaults
+// applied to an unset Logger, Backoff, or Transport.
+func ConstructCluster(roleId uint64, disk *recovery.Manager, opts ClusterOptions) (*Cluster, uint64, string, error) {
+    logger := opts.Logger
+    if logger == nil {
+        logger = NewStdLogger()
+    }
+    backoff := opts.Backoff
+    if backoff.Multiplier == 0 {
+        backoff = DefaultBackoffPolicy()
+    }
+    transport := opts.Transport
+    if transport == nil {
+        transport = TCPTransport{}
+    }
+    poolSize := opts.PoolSize
+    if poolSize <= 0 {
+        poolSize = defaultPoolSize
+    }
+    metrics := opts.Metrics
+    if metrics == nil {
+        metrics = NoopMetrics{}
+    }
+    metricsInterval := opts.MetricsInterval
+    if metricsInterval <= 0 {
+        metricsInterval = defaultMetricsInterval
+    }
+
     addresses, err := disk.RetrieveAddresses()
     if err != nil { return nil, 0, "", err }
 
@@ -41,7 +106,7 @@ func ConstructCluster(roleId uint64, disk *recovery.Manager) (*Cluster, uint64,
         newPeer := Peer {
             roleId: id,
             address: address,
-            comm: nil,
+            pool: nil,
             requirePromise: true,
         }
         peers[id] = newPeer
@@ -78,37 +143,88 @@ func ConstructCluster(roleId uint64, disk *recovery.Manager) (*Cluster, uint64,
         }
     }
 
+    ctx, cancel := context.WithCancel(context.Background())
+
     newCluster := Cluster {
         roleId: roleId,
         nodes: peers,
         registerBadConnection: make(chan uint64, 16),
         skipPromiseCount: 0,
         disk: disk,
+        ctx: ctx,
+        cancel: cancel,
+        log: logger,
+        backoff: backoff,
+        unreachable: make(chan uint64, 16),
+        transport: transport,
+        poolSize: poolSize,
+        metrics: metrics,
     }
 
     address := newCluster.nodes[newCluster.roleId].address
 
-    go newCluster.connectionManager()
+    go newCluster.connectionManager(ctx)
+    go newCluster.reportLiveConnections(ctx, metricsInterval)
 
     return &newCluster, newCluster.roleId, address, nil
 }
 
+// Shutdown cancels the cluster's root context, stopping the connection
+// manager and any in-flight reconnect loops, and closes every peer's
+// connection pool so callers can release resources deterministically.
+func (this *Cluster) Shutdown() error {
+    this.cancel()
+
+    this.exclude.Lock()
+    defer this.exclude.Unlock()
+
+    for roleId, peer := range this.nodes {
+        if peer.pool != nil {
+            peer.pool.close()
+            peer.pool = nil
+            this.nodes[roleId] = peer
+        }
+    }
+
+    return nil
+}
+
 // Sets server to listen on this node's port
-func (this *Cluster) Listen(handler *rpc.Server) error {
+func (this *Cluster) Listen(ctx context.Context, handler *rpc.Server) error {
     this.exclude.Lock()
     defer this.exclude.Unlock()
 
     // Listens on specified address
-    ln, err := net.Listen("tcp", this.nodes[this.roleId].address)
+    ln, err := this.transport.Listen(this.nodes[this.roleId].address)
     if err != nil { return err }
 
-    fmt.Println("[ NETWORK", this.roleId, "] Listening on", this.nodes[this.roleId].address)
+    this.log.Info("listening", "role", this.roleId, "addr", this.nodes[this.roleId].address)
+
+    // Closes the listener once the context is cancelled, unblocking Accept
+    go func() {
+        <- ctx.Done()
+        ln.Close()
+    }()
 
     // Dispatches connection processing loop
     go func() {
         for {
             connection, err := ln.Accept()
-            if err != nil { continue }
+            if err != nil {
+                select {
+                case <- ctx.Done():
+                    return
+                default:
+                    continue
+                }
+            }
+            if peerRoleId, err := this.verifyIncoming(connection); err != nil {
+                this.log.Warn("rejecting unauthenticated peer", "role", this.roleId, "err", err)
+                connection.Close()
+                continue
+            } else if peerRoleId != 0 {
+                this.log.Debug("accepted peer connection", "role", this.roleId, "peer", peerRoleId)
+            }
             go handler.ServeConn(connection)
         }
     }()
@@ -116,62 +232,147 @@ func (this *Cluster) Listen(handler *rpc.Server) error {
     return nil
 }
 
+// verifyIncoming checks an accepted connection's identity when the
+// cluster's transport is TLS-authenticated. It is a no-op (roleId 0, no
+// error) for transports that carry no peer identity, such as TCPTransport.
+func (this *Cluster) verifyIncoming(connection net.Conn) (uint64, error) {
+    tlsTransport, ok := this.transport.(*TLSTransport)
+    if !ok { return 0, nil }
+
+    tlsConn, ok := connection.(*tls.Conn)
+    if !ok { return 0, fmt.Errorf("clusterpeers: expected a TLS connection") }
+
+    if err := tlsConn.Handshake(); err != nil { return 0, err }
+
+    return tlsTransport.VerifyAcceptedPeer(tlsConn)
+}
+
 // Initializes connections to cluster peers
-func (this *Cluster) Connect() {
+func (this *Cluster) Connect(ctx context.Context) {
     this.exclude.Lock()
     defer this.exclude.Unlock()
 
     for roleId, peer := range this.nodes {
-        connection, err := rpc.Dial("tcp", peer.address)
-        if err != nil {
-            this.registerBadConnection <- roleId
-        } else {
-            peer.comm = connection
-            this.nodes[roleId] = peer
+        pool := newConnPool(this.transport, peer.address, this.poolSize)
+        if pool.healthyCount() == 0 {
+            select {
+            case this.registerBadConnection <- roleId:
+            case <- ctx.Done():
+            }
+            continue
         }
+        peer.pool = pool
+        this.nodes[roleId] = peer
     }
 }
 
 // Triages connection complaints, organizes repair attempts
-func (this *Cluster) connectionManager() {
+func (this *Cluster) connectionManager(ctx context.Context) {
     establishing := make(map[uint64]bool)
-    connectionEstablished := make(chan uint64)
+    attemptDone := make(chan uint64)
     for {
         select {
+        case <- ctx.Done():
+            return
         case roleId := <- this.registerBadConnection:
             if !establishing[roleId] {
-                fmt.Println("[ NETWORK", this.roleId, "] Attempting to establish connection to", roleId)
+                this.log.Info("attempting to establish connection", "role", this.roleId, "peer", roleId, "phase", "reconnect")
                 establishing[roleId] = true
-                go this.establishConnection(roleId, connectionEstablished)
+                go this.establishConnection(ctx, roleId, attemptDone)
             }
-        case roleId := <- connectionEstablished:
+        case roleId := <- attemptDone:
             establishing[roleId] = false
-            fmt.Println("[ NETWORK", this.roleId, "] Connection to", roleId, "has been established")
+            this.log.Info("reconnect attempt finished", "role", this.roleId, "peer", roleId, "phase", "reconnect")
         }
     }
 }
 
-// Attempts to re-connect to the specified role
-func (this *Cluster) establishConnection(roleId uint64, connectionEstablished chan<- uint64) {
-    this.exclude.Lock()
-    peer := this.nodes[roleId]
-    this.exclude.Unlock()
-
-    for {
-        connection, err := rpc.Dial("tcp", peer.address)
-        if err != nil {
-            time.Sleep(time.Second)
-            continue
+// Attempts to re-connect to the specified role, backing off with full
+// jitter between attempts. Once this.backoff.MaxRetries dials have failed
+// (0 means unbounded), the peer is reported on this.unreachable and the
+// loop gives up. attemptDone is signalled on every exit path - success,
+// peer removed, or budget exhausted - except cancellation of ctx, which
+// also stops connectionManager. So connectionManager always clears
+// establishing[roleId] and a later registerBadConnection for the same
+// roleId (for example from AddPeer re-adding a removed peer) is never
+// dropped by the in-flight guard.
+//
+// The address to dial is re-read from this.nodes on every attempt, not
+// captured once at the top: if a caller does RemovePeer(roleId) followed
+// by AddPeer(roleId, newAddr) while this goroutine is mid-retry, a stale
+// attempt must not install a pool dialed against the old address onto
+// the re-added peer.
+func (this *Cluster) establishConnection(ctx context.Context, roleId uint64, attemptDone chan<- uint64) {
+    for attempt := uint64(0); this.backoff.MaxRetries == 0 || attempt < this.backoff.MaxRetries; attempt++ {
+        this.exclude.Lock()
+        peer, exists := this.nodes[roleId]
+        this.exclude.Unlock()
+        if !exists {
+            this.log.Info("peer removed during reconnect, giving up", "role", this.roleId, "peer", roleId)
+            select {
+            case attemptDone <- roleId:
+            case <- ctx.Done():
+            }
+            return
+        }
+        address := peer.address
+
+        this.metrics.IncReconnectAttempt(roleId)
+        pool := newConnPool(this.transport, address, this.poolSize)
+        if pool.healthyCount() == 0 {
+            this.log.Warn("dial failed", "role", this.roleId, "peer", roleId, "attempt", attempt)
+            select {
+            case <- time.After(this.backoff.delay(attempt)):
+                continue
+            case <- ctx.Done():
+                return
+            }
         }
 
         this.exclude.Lock()
-        peer = this.nodes[roleId] 
-        peer.comm = connection
-        this.nodes[roleId] = peer
-        connectionEstablished <- roleId
+        current, exists := this.nodes[roleId]
+        if !exists {
+            this.exclude.Unlock()
+            pool.close()
+            this.log.Info("peer removed during reconnect, discarding pool", "role", this.roleId, "peer", roleId)
+            select {
+            case attemptDone <- roleId:
+            case <- ctx.Done():
+            }
+            return
+        }
+        if current.address != address {
+            this.exclude.Unlock()
+            pool.close()
+            this.log.Info("peer address changed during reconnect, discarding stale pool", "role", this.roleId, "peer", roleId, "dialed", address, "current", current.address)
+            continue
+        }
+        current.pool = pool
+        this.nodes[roleId] = current
         this.exclude.Unlock()
+
+        select {
+        case attemptDone <- roleId:
+        case <- ctx.Done():
+        }
         return
     }
+
+    this.log.Error("reconnect budget exhausted, marking peer unreachable", "role", this.roleId, "peer", roleId)
+    select {
+    case this.unreachable <- roleId:
+    case <- ctx.Done():
+    }
+    select {
+    case attemptDone <- roleId:
+    case <- ctx.Done():
+    }
+}
+
+// Unreachable delivers role ids whose reconnect budget has been exhausted,
+// so higher layers can decide to reconfigure the cluster around them.
+func (this *Cluster) Unreachable() <-chan uint64 {
+    return this.unreachable
 }
 
 // Returns number of peers in cluster
@@ -208,127 +409,222 @@ func (this *Cluster) SetPromiseRequirement(roleId uint64, required bool) {
 
     peer.requirePromise = required
     this.nodes[roleId] = peer
+    this.metrics.SetSkipPromiseCount(this.skipPromiseCount)
+}
+
+// Derives a deadline-bound child context from ctx, falling back to def
+// when ctx carries no deadline of its own.
+func withDefaultTimeout(ctx context.Context, def time.Duration) (context.Context, context.CancelFunc) {
+    if _, ok := ctx.Deadline(); ok {
+        return context.WithCancel(ctx)
+    }
+    return context.WithTimeout(ctx, def)
 }
 
 // Sends pulse to all nodes in the cluster
-func (this *Cluster) BroadcastHeartbeat(roleId uint64) {
+func (this *Cluster) BroadcastHeartbeat(ctx context.Context, roleId uint64) {
     this.exclude.Lock()
     defer this.exclude.Unlock()
 
+    ctx, cancel := withDefaultTimeout(ctx, defaultHeartbeatTimeout)
+    defer cancel()
+
     peerCount := len(this.nodes)
     endpoint := make(chan *rpc.Call, peerCount)
-    for _, peer := range this.nodes {
-        if peer.comm != nil {
+    startTimes := make(map[uint64]time.Time, peerCount)
+    calls := make(map[*rpc.Call]poolEntry, peerCount)
+    dispatched := 0
+    for peerId, peer := range this.nodes {
+        if peer.pool == nil { continue }
+        if client, err := peer.pool.next(); err == nil {
             var reply uint64
-            peer.comm.Go("ProposerRole.Heartbeat", &roleId, &reply, endpoint)
+            atomic.AddInt64(&this.inFlight, 1)
+            dispatched++
+            startTimes[peerId] = time.Now()
+            call := client.Go("ProposerRole.Heartbeat", &roleId, &reply, endpoint)
+            calls[call] = poolEntry{pool: peer.pool, client: client}
         }
     }
 
     // Records nodes which return the heartbeat signal
     received := make(map[uint64]bool)
-    failures := false
     replyCount := 0
-    for replyCount < peerCount {
+    for replyCount < dispatched {
         select {
         case reply := <- endpoint:
+            atomic.AddInt64(&this.inFlight, -1)
             if reply.Error == nil {
                 id := *reply.Reply.(*uint64)
-                received[id] = true 
+                received[id] = true
+                if start, ok := startTimes[id]; ok {
+                    this.metrics.ObserveHeartbeatLatency(id, time.Since(start))
+                }
             } else {
-                failures = true
+                this.metrics.IncRPCError("heartbeat")
+                if entry, ok := calls[reply]; ok {
+                    entry.pool.markUnhealthy(entry.client)
+                }
             }
+            delete(calls, reply)
             replyCount++
-        case <- time.After(time.Second/2):
-            failures = true
-            replyCount = peerCount
+        case <- ctx.Done():
+            atomic.AddInt64(&this.inFlight, -int64(dispatched-replyCount))
+            // Calls still outstanding here are on a connection that never
+            // answered within the deadline - a wedged socket, not merely an
+            // RPC error. Sideline it too, or next() keeps handing it out.
+            for _, entry := range calls {
+                entry.pool.markUnhealthy(entry.client)
+            }
+            replyCount = dispatched
         }
     }
-    
-    // Registers bad connections if reply was not received
-    if failures {
-        for roleId := range this.nodes {
-            if !received[roleId] {
-                peer := this.nodes[roleId]
-                if !peer.requirePromise {
-                    this.skipPromiseCount--
-                }
-                peer.requirePromise = true
-                this.nodes[roleId] = peer
-                this.registerBadConnection <- roleId
+
+    // Registers bad connections for every node that didn't answer this
+    // round, whether it was dispatched to and failed/timed out, or never
+    // dispatched to at all because its pool had already gone unhealthy.
+    // This runs unconditionally - not just when a dispatched call errored -
+    // so a peer whose pool silently dropped to zero healthy connections is
+    // still re-queued for reconnection instead of being stranded forever.
+    for roleId := range this.nodes {
+        if !received[roleId] {
+            peer := this.nodes[roleId]
+            if !peer.requirePromise {
+                this.skipPromiseCount--
+            }
+            peer.requirePromise = true
+            this.nodes[roleId] = peer
+            this.metrics.SetSkipPromiseCount(this.skipPromiseCount)
+            this.log.Warn("no heartbeat reply", "role", this.roleId, "peer", roleId, "phase", "heartbeat")
+            select {
+            case this.registerBadConnection <- roleId:
+            case <- this.ctx.Done():
             }
         }
     }
 }
 
 // Broadcasts a prepare phase request to the cluster
-func (this *Cluster) BroadcastPrepareRequest(request acceptor.PrepareReq) (uint64, <-chan Response) {
+func (this *Cluster) BroadcastPrepareRequest(ctx context.Context, request acceptor.PrepareReq) (uint64, <-chan Response) {
     this.exclude.Lock()
     defer this.exclude.Unlock()
 
     peerCount := uint64(0)
     nodeCount := uint64(len(this.nodes))
     endpoint := make(chan *rpc.Call, nodeCount)
+    calls := make(map[*rpc.Call]poolEntry, nodeCount)
 
     if this.skipPromiseCount < nodeCount/2+1 {
         for _, peer := range this.nodes {
-            if peer.requirePromise && peer.comm != nil {
-                var response acceptor.PrepareResp
-                peer.comm.Go("AcceptorRole.Prepare", &request, &response, endpoint)
-                peerCount++
-            } 
+            if !peer.requirePromise || peer.pool == nil { continue }
+            client, err := peer.pool.next()
+            if err != nil { continue }
+            var response acceptor.PrepareResp
+            atomic.AddInt64(&this.inFlight, 1)
+            call := client.Go("AcceptorRole.Prepare", &request, &response, endpoint)
+            calls[call] = poolEntry{pool: peer.pool, client: client}
+            peerCount++
         }
     } else {
-        fmt.Println("[ NETWORK", this.roleId, "] Skipping prepare phase: know state of majority")
+        this.log.Debug("skipping prepare phase: know state of majority", "role", this.roleId, "phase", "prepare")
     }
 
 
+    this.metrics.ObserveBroadcastFanout("prepare", peerCount)
     responses := make(chan Response, peerCount)
-    go this.wrapReply(peerCount, endpoint, responses)
-    return peerCount, responses 
+    go this.wrapReply(ctx, peerCount, endpoint, responses, "prepare", calls)
+    return peerCount, responses
 }
 
 // Broadcasts a proposal phase request to the cluster
-func (this *Cluster) BroadcastProposalRequest(request acceptor.ProposalReq, filter map[uint64]bool) (uint64, <-chan Response) {
+func (this *Cluster) BroadcastProposalRequest(ctx context.Context, request acceptor.ProposalReq, filter map[uint64]bool) (uint64, <-chan Response) {
     this.exclude.Lock()
     defer this.exclude.Unlock()
 
     peerCount := uint64(0)
-    endpoint := make(chan *rpc.Call, len(this.nodes)) 
+    endpoint := make(chan *rpc.Call, len(this.nodes))
+    calls := make(map[*rpc.Call]poolEntry, len(this.nodes))
     for roleId, peer := range this.nodes {
-        if !filter[roleId] && peer.comm != nil {
-            var response acceptor.ProposalResp
-            peer.comm.Go("AcceptorRole.Accept", &request, &response, endpoint)
-            peerCount++
-        }
+        if filter[roleId] || peer.pool == nil { continue }
+        client, err := peer.pool.next()
+        if err != nil { continue }
+        var response acceptor.ProposalResp
+        atomic.AddInt64(&this.inFlight, 1)
+        call := client.Go("AcceptorRole.Accept", &request, &response, endpoint)
+        calls[call] = poolEntry{pool: peer.pool, client: client}
+        peerCount++
     }
 
+    this.metrics.ObserveBroadcastFanout("accept", peerCount)
     responses := make(chan Response, peerCount)
-    go this.wrapReply(peerCount, endpoint, responses)
-    return peerCount, responses 
+    go this.wrapReply(ctx, peerCount, endpoint, responses, "accept", calls)
+    return peerCount, responses
 }
 
 // Directly notifies a specific node of a chosen value
-func (this *Cluster) NotifyOfSuccess(roleId uint64, info acceptor.SuccessNotify) <-chan Response {
+func (this *Cluster) NotifyOfSuccess(ctx context.Context, roleId uint64, info acceptor.SuccessNotify) <-chan Response {
+    this.exclude.Lock()
+    peer := this.nodes[roleId]
+    this.exclude.Unlock()
+
+    if peer.pool == nil {
+        this.log.Warn("no connection pool for success notification", "role", this.roleId, "peer", roleId)
+        response := make(chan Response)
+        close(response)
+        return response
+    }
+
     endpoint := make(chan *rpc.Call, 1)
     var firstUnchosenIndex int
-    this.nodes[roleId].comm.Go("AcceptorRole.Success", &info, &firstUnchosenIndex, endpoint)
+    client, err := peer.pool.next()
+    if err != nil {
+        this.log.Warn("no healthy connection for success notification", "role", this.roleId, "peer", roleId, "err", err)
+        response := make(chan Response)
+        close(response)
+        return response
+    }
+    atomic.AddInt64(&this.inFlight, 1)
+    call := client.Go("AcceptorRole.Success", &info, &firstUnchosenIndex, endpoint)
+    calls := map[*rpc.Call]poolEntry{call: {pool: peer.pool, client: client}}
 
     response := make(chan Response)
-    go this.wrapReply(1, endpoint, response)
+    go this.wrapReply(ctx, 1, endpoint, response, "success", calls)
     return response
 }
 
-// Wraps RPC return data to remove direct dependency of caller on net/rpc and improve testability
-func (this *Cluster) wrapReply(peerCount uint64, endpoint <-chan *rpc.Call, forward chan<- Response) {
+// Wraps RPC return data to remove direct dependency of caller on net/rpc and
+// improve testability. phase labels the error/latency metrics it emits.
+// calls maps each dispatched *rpc.Call back to the pooled connection that
+// carried it, so a failing reply can retire that one connection.
+func (this *Cluster) wrapReply(ctx context.Context, peerCount uint64, endpoint <-chan *rpc.Call, forward chan<- Response, phase string, calls map[*rpc.Call]poolEntry) {
+    start := time.Now()
+    ctx, cancel := withDefaultTimeout(ctx, defaultReplyTimeout)
+    defer cancel()
+    defer func() { this.metrics.ObserveBroadcastLatency(phase, time.Since(start)) }()
+
     replyCount := uint64(0)
     for replyCount < peerCount {
         select {
         case reply := <- endpoint:
+            atomic.AddInt64(&this.inFlight, -1)
             if reply.Error == nil {
                 forward <- Response{reply.Reply}
+            } else {
+                this.log.Warn("rpc call failed", "role", this.roleId, "phase", phase, "err", reply.Error)
+                this.metrics.IncRPCError(phase)
+                if entry, ok := calls[reply]; ok {
+                    entry.pool.markUnhealthy(entry.client)
+                }
             }
+            delete(calls, reply)
             replyCount++
-        case <- time.After(2*time.Second):
+        case <- ctx.Done():
+            atomic.AddInt64(&this.inFlight, -int64(peerCount-replyCount))
+            // Calls still outstanding here are on a connection that never
+            // answered within the deadline - a wedged socket, not merely an
+            // RPC error. Sideline it too, or next() keeps handing it out.
+            for _, entry := range calls {
+                entry.pool.markUnhealthy(entry.client)
+            }
             return
         }
     }
@@ -0,0 +1,57 @@
+package clusterpeers
+
+import (
+    "fmt"
+    "log"
+    "os"
+)
+
+// Logger is the structured logging interface used throughout clusterpeers.
+// Implementations should treat kv as alternating key/value pairs (e.g.
+// "peer", roleId, "phase", "prepare") and are free to ignore malformed
+// trailing keys.
+type Logger interface {
+    Debug(msg string, kv ...interface{})
+    Info(msg string, kv ...interface{})
+    Warn(msg string, kv ...interface{})
+    Error(msg string, kv ...interface{})
+}
+
+// StdLogger is the default Logger, backed by the standard library's log
+// package. It renders kv pairs inline after the message.
+type StdLogger struct {
+    logger *log.Logger
+}
+
+// NewStdLogger builds a StdLogger writing to stderr.
+func NewStdLogger() *StdLogger {
+    return &StdLogger{logger: log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+func (this *StdLogger) Debug(msg string, kv ...interface{}) { this.log("DEBUG", msg, kv...) }
+func (this *StdLogger) Info(msg string, kv ...interface{})  { this.log("INFO", msg, kv...) }
+func (this *StdLogger) Warn(msg string, kv ...interface{})  { this.log("WARN", msg, kv...) }
+func (this *StdLogger) Error(msg string, kv ...interface{}) { this.log("ERROR", msg, kv...) }
+
+func (this *StdLogger) log(level string, msg string, kv ...interface{}) {
+    this.logger.Println(level, msg, formatKV(kv))
+}
+
+// formatKV renders alternating key/value pairs as "key=value key=value ...".
+func formatKV(kv []interface{}) string {
+    out := ""
+    for i := 0; i+1 < len(kv); i += 2 {
+        if i > 0 { out += " " }
+        out += fmt.Sprintf("%v=%v", kv[i], kv[i+1])
+    }
+    return out
+}
+
+// NoopLogger discards every call. Useful for tests that don't care about
+// log output.
+type NoopLogger struct{}
+
+func (NoopLogger) Debug(msg string, kv ...interface{}) {}
+func (NoopLogger) Info(msg string, kv ...interface{})  {}
+func (NoopLogger) Warn(msg string, kv ...interface{})  {}
+func (NoopLogger) Error(msg string, kv ...interface{}) {}
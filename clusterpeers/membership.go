@@ -0,0 +1,140 @@
+package clusterpeers
+
+import "fmt"
+
+// roleIdRegistry is implemented by transports (TLSTransport) that need to
+// learn about membership changes made after construction, so identity
+// verification keys off the live node table instead of a frozen snapshot.
+// Transports that don't authenticate by address, like TCPTransport, simply
+// don't implement it, and the type assertion below is skipped.
+type roleIdRegistry interface {
+    UpdateRoleId(roleId uint64, address string)
+    RemoveRoleId(address string)
+}
+
+// AddPeer registers a new node in the cluster. The new peer requires a
+// promise before accept requests are sent to it, persists to disk, and is
+// dialed by the connection manager on the next bad-connection sweep.
+// Broadcasts pick their target peers while holding this.exclude, so a
+// broadcast already dispatched never includes the new peer; it is only
+// ever observed starting at the next round.
+func (this *Cluster) AddPeer(roleId uint64, address string) error {
+    this.exclude.Lock()
+    defer this.exclude.Unlock()
+
+    if _, exists := this.nodes[roleId]; exists {
+        return fmt.Errorf("clusterpeers: peer %d already exists", roleId)
+    }
+
+    if err := this.disk.PersistAddress(roleId, address); err != nil {
+        return err
+    }
+
+    this.nodes[roleId] = Peer {
+        roleId: roleId,
+        address: address,
+        pool: nil,
+        requirePromise: true,
+    }
+
+    if registry, ok := this.transport.(roleIdRegistry); ok {
+        registry.UpdateRoleId(roleId, address)
+    }
+
+    this.log.Info("peer added", "role", this.roleId, "peer", roleId, "addr", address)
+
+    select {
+    case this.registerBadConnection <- roleId:
+    case <- this.ctx.Done():
+    }
+
+    return nil
+}
+
+// RemovePeer drops a node from the cluster, closing its connection if one
+// is live, persisting the removal, and recomputing skipPromiseCount so
+// majority calculations in BroadcastPrepareRequest no longer account for
+// the removed peer.
+func (this *Cluster) RemovePeer(roleId uint64) error {
+    this.exclude.Lock()
+    defer this.exclude.Unlock()
+
+    peer, exists := this.nodes[roleId]
+    if !exists {
+        return fmt.Errorf("clusterpeers: peer %d does not exist", roleId)
+    }
+
+    if err := this.disk.RemoveAddress(roleId); err != nil {
+        return err
+    }
+
+    if peer.pool != nil {
+        peer.pool.close()
+    }
+    if !peer.requirePromise {
+        this.skipPromiseCount--
+    }
+    delete(this.nodes, roleId)
+
+    if registry, ok := this.transport.(roleIdRegistry); ok {
+        registry.RemoveRoleId(peer.address)
+    }
+
+    this.log.Info("peer removed", "role", this.roleId, "peer", roleId)
+
+    return nil
+}
+
+// ReplacePeer atomically swaps oldId for newId at addr: the old peer's
+// connection is torn down and its address record removed, and the new
+// peer is added fresh (requiring a promise, as any newly added peer does).
+// Both mutations happen under a single hold of this.exclude.
+func (this *Cluster) ReplacePeer(oldId uint64, newId uint64, addr string) error {
+    this.exclude.Lock()
+
+    peer, exists := this.nodes[oldId]
+    if !exists {
+        this.exclude.Unlock()
+        return fmt.Errorf("clusterpeers: peer %d does not exist", oldId)
+    }
+
+    if err := this.disk.RemoveAddress(oldId); err != nil {
+        this.exclude.Unlock()
+        return err
+    }
+    if err := this.disk.PersistAddress(newId, addr); err != nil {
+        this.exclude.Unlock()
+        return err
+    }
+
+    if peer.pool != nil {
+        peer.pool.close()
+    }
+    if !peer.requirePromise {
+        this.skipPromiseCount--
+    }
+    delete(this.nodes, oldId)
+
+    this.nodes[newId] = Peer {
+        roleId: newId,
+        address: addr,
+        pool: nil,
+        requirePromise: true,
+    }
+
+    if registry, ok := this.transport.(roleIdRegistry); ok {
+        registry.RemoveRoleId(peer.address)
+        registry.UpdateRoleId(newId, addr)
+    }
+
+    this.log.Info("peer replaced", "role", this.roleId, "oldPeer", oldId, "newPeer", newId, "addr", addr)
+
+    this.exclude.Unlock()
+
+    select {
+    case this.registerBadConnection <- newId:
+    case <- this.ctx.Done():
+    }
+
+    return nil
+}
@@ -0,0 +1,134 @@
+package clusterpeers
+
+import (
+    "strconv"
+    "time"
+
+    "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics is the instrumentation surface Cluster reports through. It
+// mirrors the raw data the heartbeat and broadcast paths already compute,
+// formalizing it so operators can alert on quorum-loss conditions (e.g.
+// fewer than N/2+1 live connections) before Paxos actually stalls.
+type Metrics interface {
+    ObserveHeartbeatLatency(peer uint64, d time.Duration)
+    ObserveBroadcastFanout(phase string, size uint64)
+    ObserveBroadcastLatency(phase string, d time.Duration)
+    IncRPCError(phase string)
+    SetSkipPromiseCount(n uint64)
+    SetLiveConnections(n int)
+    IncReconnectAttempt(peer uint64)
+}
+
+// NoopMetrics discards every observation. It is the default when
+// ClusterOptions.Metrics is left unset.
+type NoopMetrics struct{}
+
+func (NoopMetrics) ObserveHeartbeatLatency(peer uint64, d time.Duration) {}
+func (NoopMetrics) ObserveBroadcastFanout(phase string, size uint64) {}
+func (NoopMetrics) ObserveBroadcastLatency(phase string, d time.Duration) {}
+func (NoopMetrics) IncRPCError(phase string) {}
+func (NoopMetrics) SetSkipPromiseCount(n uint64) {}
+func (NoopMetrics) SetLiveConnections(n int) {}
+func (NoopMetrics) IncReconnectAttempt(peer uint64) {}
+
+// PrometheusMetrics is the production Metrics implementation.
+type PrometheusMetrics struct {
+    heartbeatLatency *prometheus.HistogramVec
+    broadcastFanout *prometheus.HistogramVec
+    broadcastLatency *prometheus.HistogramVec
+    rpcErrors *prometheus.CounterVec
+    skipPromiseCount prometheus.Gauge
+    liveConnections prometheus.Gauge
+    reconnectAttempts *prometheus.CounterVec
+}
+
+// NewPrometheusMetrics registers the cluster's collectors against
+// registerer and returns a Metrics backed by them.
+func NewPrometheusMetrics(registerer prometheus.Registerer) *PrometheusMetrics {
+    metrics := &PrometheusMetrics {
+        heartbeatLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "heartbeat_latency_seconds",
+            Help: "Round-trip latency of heartbeats to each peer.",
+        }, []string{"peer"}),
+        broadcastFanout: prometheus.NewHistogramVec(prometheus.HistogramOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "broadcast_fanout",
+            Help: "Number of peers a prepare/accept broadcast was sent to.",
+        }, []string{"phase"}),
+        broadcastLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "broadcast_latency_seconds",
+            Help: "Time to collect all broadcast replies or time out.",
+        }, []string{"phase"}),
+        rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "rpc_errors_total",
+            Help: "RPC errors observed, by phase.",
+        }, []string{"phase"}),
+        skipPromiseCount: prometheus.NewGauge(prometheus.GaugeOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "skip_promise_count",
+            Help: "Number of peers from which no promise is currently required.",
+        }),
+        liveConnections: prometheus.NewGauge(prometheus.GaugeOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "live_connections",
+            Help: "Number of peers with at least one healthy pooled connection.",
+        }),
+        reconnectAttempts: prometheus.NewCounterVec(prometheus.CounterOpts {
+            Namespace: "paxos",
+            Subsystem: "cluster",
+            Name: "reconnect_attempts_total",
+            Help: "Reconnect dial attempts, by peer.",
+        }, []string{"peer"}),
+    }
+
+    registerer.MustRegister(
+        metrics.heartbeatLatency,
+        metrics.broadcastFanout,
+        metrics.broadcastLatency,
+        metrics.rpcErrors,
+        metrics.skipPromiseCount,
+        metrics.liveConnections,
+        metrics.reconnectAttempts,
+    )
+
+    return metrics
+}
+
+func (this *PrometheusMetrics) ObserveHeartbeatLatency(peer uint64, d time.Duration) {
+    this.heartbeatLatency.WithLabelValues(strconv.FormatUint(peer, 10)).Observe(d.Seconds())
+}
+
+func (this *PrometheusMetrics) ObserveBroadcastFanout(phase string, size uint64) {
+    this.broadcastFanout.WithLabelValues(phase).Observe(float64(size))
+}
+
+func (this *PrometheusMetrics) ObserveBroadcastLatency(phase string, d time.Duration) {
+    this.broadcastLatency.WithLabelValues(phase).Observe(d.Seconds())
+}
+
+func (this *PrometheusMetrics) IncRPCError(phase string) {
+    this.rpcErrors.WithLabelValues(phase).Inc()
+}
+
+func (this *PrometheusMetrics) SetSkipPromiseCount(n uint64) {
+    this.skipPromiseCount.Set(float64(n))
+}
+
+func (this *PrometheusMetrics) SetLiveConnections(n int) {
+    this.liveConnections.Set(float64(n))
+}
+
+func (this *PrometheusMetrics) IncReconnectAttempt(peer uint64) {
+    this.reconnectAttempts.WithLabelValues(strconv.FormatUint(peer, 10)).Inc()
+}
@@ -0,0 +1,111 @@
+package clusterpeers
+
+import (
+    "fmt"
+    "net/rpc"
+    "sync"
+)
+
+// defaultPoolSize is used when ClusterOptions.PoolSize is left at zero.
+const defaultPoolSize = 4
+
+// connPool is a small, round-robin pool of RPC clients to a single peer.
+// Spreading prepare/accept/heartbeat calls across several connections
+// means one stalled socket no longer head-of-line blocks every Paxos
+// instance addressed to that peer.
+type connPool struct {
+    mu sync.Mutex
+    conns []*pooledConn
+    nextIdx uint64
+}
+
+type pooledConn struct {
+    client *rpc.Client
+    healthy bool
+}
+
+// poolEntry identifies which pool and which of its clients a dispatched
+// *rpc.Call came from, so a failed reply can retire that one connection
+// with markUnhealthy instead of the whole peer.
+type poolEntry struct {
+    pool *connPool
+    client *rpc.Client
+}
+
+// newConnPool dials up to size connections to address. A dial failure for
+// any one slot is tolerated (that slot is simply absent); the pool is
+// only empty if every dial failed.
+func newConnPool(transport Transport, address string, size int) *connPool {
+    if size <= 0 { size = defaultPoolSize }
+
+    pool := &connPool{conns: make([]*pooledConn, 0, size)}
+    for i := 0; i < size; i++ {
+        conn, err := transport.Dial(address)
+        if err != nil { continue }
+        client, _ := newRPCClient(conn)
+        pool.conns = append(pool.conns, &pooledConn{client: client, healthy: true})
+    }
+    return pool
+}
+
+// next round-robins over healthy connections, skipping any marked
+// unhealthy. It returns an error if the pool has no healthy connection.
+func (this *connPool) next() (*rpc.Client, error) {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    for i := 0; i < len(this.conns); i++ {
+        idx := (this.nextIdx + uint64(i)) % uint64(len(this.conns))
+        if this.conns[idx].healthy {
+            this.nextIdx = idx + 1
+            return this.conns[idx].client, nil
+        }
+    }
+
+    return nil, fmt.Errorf("clusterpeers: no healthy connection in pool")
+}
+
+// markUnhealthy sidelines the connection backed by client so future next()
+// calls skip it until the pool is rebuilt by a reconnect.
+func (this *connPool) markUnhealthy(client *rpc.Client) {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    for _, conn := range this.conns {
+        if conn.client == client {
+            conn.healthy = false
+            return
+        }
+    }
+}
+
+// healthyCount reports how many pooled connections are currently usable.
+func (this *connPool) healthyCount() int {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    count := 0
+    for _, conn := range this.conns {
+        if conn.healthy { count++ }
+    }
+    return count
+}
+
+// size reports how many connections were successfully dialed into the
+// pool, healthy or not.
+func (this *connPool) size() int {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    return len(this.conns)
+}
+
+// close tears down every connection in the pool.
+func (this *connPool) close() {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    for _, conn := range this.conns {
+        conn.client.Close()
+    }
+}
@@ -0,0 +1,78 @@
+package clusterpeers
+
+import (
+    "context"
+    "sync/atomic"
+    "time"
+)
+
+// PeerPoolStats describes the connection pool backing a single peer.
+type PeerPoolStats struct {
+    PoolSize int
+    Healthy int
+}
+
+// ClusterStats is a point-in-time snapshot of the cluster's connection
+// pools and pipelining load, suitable for exposing through a Stats()
+// call site or adapting into a metrics system.
+type ClusterStats struct {
+    Peers map[uint64]PeerPoolStats
+    InFlight int64
+}
+
+// Stats reports per-peer pool health alongside the number of RPC calls
+// this node has dispatched and not yet received a reply for. Calls still
+// outstanding when their broadcast's deadline passes are no longer counted.
+func (this *Cluster) Stats() ClusterStats {
+    this.exclude.Lock()
+    defer this.exclude.Unlock()
+
+    peers, liveConnections := this.poolStatsLocked()
+    this.metrics.SetLiveConnections(liveConnections)
+
+    return ClusterStats {
+        Peers: peers,
+        InFlight: atomic.LoadInt64(&this.inFlight),
+    }
+}
+
+// poolStatsLocked builds the per-peer pool snapshot and counts peers with
+// at least one healthy connection. Callers must hold this.exclude.
+func (this *Cluster) poolStatsLocked() (map[uint64]PeerPoolStats, int) {
+    peers := make(map[uint64]PeerPoolStats, len(this.nodes))
+    liveConnections := 0
+    for roleId, peer := range this.nodes {
+        if peer.pool == nil {
+            peers[roleId] = PeerPoolStats{}
+            continue
+        }
+        healthy := peer.pool.healthyCount()
+        peers[roleId] = PeerPoolStats {
+            PoolSize: peer.pool.size(),
+            Healthy: healthy,
+        }
+        if healthy > 0 { liveConnections++ }
+    }
+    return peers, liveConnections
+}
+
+// reportLiveConnections periodically samples pool health and drives the
+// live_connections gauge, so the quorum-loss signal the request asks for
+// (fewer than N/2+1 live connections) updates on its own instead of only
+// when something happens to poll Stats().
+func (this *Cluster) reportLiveConnections(ctx context.Context, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <- ctx.Done():
+            return
+        case <- ticker.C:
+            this.exclude.Lock()
+            _, liveConnections := this.poolStatsLocked()
+            this.exclude.Unlock()
+            this.metrics.SetLiveConnections(liveConnections)
+        }
+    }
+}
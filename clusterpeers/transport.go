@@ -0,0 +1,172 @@
+package clusterpeers
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "net"
+    "net/rpc"
+    "strconv"
+    "sync"
+
+    "paxos/recovery"
+)
+
+// newRPCClient wraps a Transport-supplied connection in a gob-codec RPC
+// client, mirroring what rpc.Dial does internally for a plain net.Conn.
+func newRPCClient(connection net.Conn) (*rpc.Client, error) {
+    return rpc.NewClient(connection), nil
+}
+
+// Transport supplies the network primitives Cluster uses to listen for and
+// dial peer connections. Swapping the transport is how mutual-TLS (or any
+// other connection hardening) gets plugged in without touching the Paxos
+// broadcast logic.
+type Transport interface {
+    Listen(addr string) (net.Listener, error)
+    Dial(addr string) (net.Conn, error)
+}
+
+// TCPTransport is the plain, unauthenticated transport the cluster used
+// before TLS support existed. It remains the default for tests and
+// trusted-network deployments.
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+func (TCPTransport) Dial(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+
+// TLSTransport is a mutual-TLS Transport. Every dial and accept is
+// authenticated against the peer CA. On dial, the peer's presented
+// certificate must carry the dialed address's roleId as its CommonName or
+// a DNS SAN, so a compromised or misconfigured node cannot impersonate
+// another role. On accept, VerifyAcceptedPeer only requires the
+// certificate to carry some recorded roleId.
+type TLSTransport struct {
+    config *tls.Config
+
+    mu sync.RWMutex
+    roleIdByAddress map[string]uint64
+}
+
+// NewTLSTransport loads this node's certificate/key and the peer CA from
+// disk and builds a TLSTransport that cross-checks peer identities
+// against addresses.
+func NewTLSTransport(disk *recovery.Manager, addresses map[uint64]string) (*TLSTransport, error) {
+    cert, caPEM, err := disk.RetrieveTLSMaterial()
+    if err != nil { return nil, err }
+
+    peerCAs := x509.NewCertPool()
+    if !peerCAs.AppendCertsFromPEM(caPEM) {
+        return nil, fmt.Errorf("clusterpeers: no certificates found in peer CA bundle")
+    }
+
+    roleIdByAddress := make(map[string]uint64, len(addresses))
+    for roleId, address := range addresses {
+        roleIdByAddress[address] = roleId
+    }
+
+    transport := &TLSTransport{roleIdByAddress: roleIdByAddress}
+    transport.config = &tls.Config {
+        Certificates: []tls.Certificate{cert},
+        ClientCAs: peerCAs,
+        RootCAs: peerCAs,
+        ClientAuth: tls.RequireAndVerifyClientCert,
+    }
+
+    return transport, nil
+}
+
+func (this *TLSTransport) Listen(addr string) (net.Listener, error) {
+    return tls.Listen("tcp", addr, this.config)
+}
+
+func (this *TLSTransport) Dial(addr string) (net.Conn, error) {
+    conn, err := tls.Dial("tcp", addr, this.config)
+    if err != nil { return nil, err }
+    if err := this.verifyPeerRoleId(conn, addr); err != nil {
+        conn.Close()
+        return nil, err
+    }
+    return conn, nil
+}
+
+// VerifyAcceptedPeer checks an accepted connection's certificate against
+// every recorded roleId, returning the matching roleId. Cluster.Listen
+// calls this before handing the connection to the RPC server, since an
+// accepting listener does not know in advance which peer is dialing in.
+func (this *TLSTransport) VerifyAcceptedPeer(conn *tls.Conn) (uint64, error) {
+    state := conn.ConnectionState()
+    if len(state.PeerCertificates) == 0 {
+        return 0, fmt.Errorf("clusterpeers: incoming peer presented no certificate")
+    }
+    cert := state.PeerCertificates[0]
+
+    this.mu.RLock()
+    defer this.mu.RUnlock()
+
+    for _, roleId := range this.roleIdByAddress {
+        identity := strconv.FormatUint(roleId, 10)
+        if cert.Subject.CommonName == identity {
+            return roleId, nil
+        }
+        for _, name := range cert.DNSNames {
+            if name == identity {
+                return roleId, nil
+            }
+        }
+    }
+
+    return 0, fmt.Errorf("clusterpeers: certificate CN %q does not match any known roleId", cert.Subject.CommonName)
+}
+
+// verifyPeerRoleId rejects connections whose certificate does not carry
+// the roleId recorded for addr as its CommonName or a DNS SAN. addr must be
+// a recorded peer address, so incoming connections, whose remote address
+// is not one, are checked by VerifyAcceptedPeer instead.
+func (this *TLSTransport) verifyPeerRoleId(conn *tls.Conn, addr string) error {
+    this.mu.RLock()
+    expectedRoleId, known := this.roleIdByAddress[addr]
+    this.mu.RUnlock()
+    if !known {
+        return fmt.Errorf("clusterpeers: no recorded roleId for address %s", addr)
+    }
+    expectedIdentity := strconv.FormatUint(expectedRoleId, 10)
+
+    state := conn.ConnectionState()
+    if len(state.PeerCertificates) == 0 {
+        return fmt.Errorf("clusterpeers: peer at %s presented no certificate", addr)
+    }
+    cert := state.PeerCertificates[0]
+
+    if cert.Subject.CommonName == expectedIdentity {
+        return nil
+    }
+    for _, name := range cert.DNSNames {
+        if name == expectedIdentity {
+            return nil
+        }
+    }
+
+    return fmt.Errorf("clusterpeers: certificate for %s does not match recorded roleId %d", addr, expectedRoleId)
+}
+
+// UpdateRoleId records that address now belongs to roleId, so a later
+// Dial to address (or an incoming connection claiming it) is verified
+// against the live membership rather than the construction-time
+// snapshot. Cluster.AddPeer/ReplacePeer call this through the
+// roleIdRegistry hook so TLS verification tracks online reconfiguration.
+func (this *TLSTransport) UpdateRoleId(roleId uint64, address string) {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    this.roleIdByAddress[address] = roleId
+}
+
+// RemoveRoleId forgets address's recorded roleId, so a stale certificate
+// for a removed or replaced peer is no longer accepted at that address.
+func (this *TLSTransport) RemoveRoleId(address string) {
+    this.mu.Lock()
+    defer this.mu.Unlock()
+
+    delete(this.roleIdByAddress, address)
+}